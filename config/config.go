@@ -0,0 +1,131 @@
+// Package config defines kafka-pixy's configuration schema, including the
+// knobs `consumer/groupmember` uses to pick a group coordination backend
+// and balancing/assignment strategy.
+package config
+
+import (
+	"time"
+
+	"github.com/mailgun/sarama"
+)
+
+// Coordinator selects which consumer group coordination backend
+// `groupmember.Spawn` uses to track membership and partition ownership.
+type Coordinator string
+
+const (
+	// CoordinatorZooKeeper drives group membership through the legacy
+	// `/consumers` ZooKeeper tree via kazoo-go. It is the default, for
+	// compatibility with clusters and deployments that predate the native
+	// Kafka group coordinator support.
+	CoordinatorZooKeeper Coordinator = "zookeeper"
+	// CoordinatorKafka drives group membership through the broker's native
+	// group coordinator (FindCoordinator/JoinGroup/SyncGroup/Heartbeat),
+	// for clusters that no longer expose `/consumers` znodes.
+	CoordinatorKafka Coordinator = "kafka"
+)
+
+// BalanceStrategy selects how a consumer group reacts to membership
+// changes.
+type BalanceStrategy string
+
+const (
+	// BalanceStrategyEager drops every member's partitions and reassigns
+	// the whole group from scratch on any membership change. It is the
+	// default.
+	BalanceStrategyEager BalanceStrategy = "eager"
+	// BalanceStrategyCooperativeSticky rebalances incrementally: a member
+	// is first notified of only the specific topics the plan revokes from
+	// it, and then of the topics assigned to it, so that members whose
+	// assignment is unaffected never see their claims churn (KIP-429).
+	// Members do not wait for each other between the two phases.
+	BalanceStrategyCooperativeSticky BalanceStrategy = "cooperative-sticky"
+)
+
+// AssignmentStrategy selects how a consumer group divides a topic's
+// partitions among its members.
+type AssignmentStrategy string
+
+const (
+	// AssignmentStrategyRange assigns each member a contiguous range of a
+	// topic's partitions. It is the default.
+	AssignmentStrategyRange AssignmentStrategy = "range"
+	// AssignmentStrategyRoundRobin assigns a topic's partitions to members
+	// one at a time in round-robin order.
+	AssignmentStrategyRoundRobin AssignmentStrategy = "roundrobin"
+	// AssignmentStrategySticky consults the group's previous generation
+	// assignment and only moves the partitions of members who left,
+	// minimizing overall consumer churn across rebalances.
+	AssignmentStrategySticky AssignmentStrategy = "sticky"
+)
+
+// T is the root of kafka-pixy's configuration.
+type T struct {
+	// ClientID is included in every request kafka-pixy sends to Kafka, to
+	// identify it in broker-side logs and quotas.
+	ClientID string
+
+	Kafka struct {
+		// SeedPeers is the list of `host:port` addresses kafka-pixy uses to
+		// discover the rest of the cluster.
+		SeedPeers []string
+		// Version is the minimum Kafka protocol version kafka-pixy speaks.
+		Version sarama.KafkaVersion
+	}
+
+	ZooKeeper struct {
+		// SeedPeers is the list of `host:port` addresses of the ZooKeeper
+		// ensemble backing the legacy `/consumers` tree.
+		SeedPeers []string
+		// Chroot is the path ZooKeeper paths are rooted under, mirroring
+		// kazoo-go's `Config.Chroot`.
+		Chroot string
+	}
+
+	Consumer struct {
+		// Coordinator selects the group coordination backend, see
+		// Coordinator.
+		Coordinator Coordinator
+		// BalanceStrategy selects how a group reacts to membership
+		// changes, see BalanceStrategy.
+		BalanceStrategy BalanceStrategy
+		// PartitionAssignmentStrategy selects how a topic's partitions are
+		// divided among group members, see AssignmentStrategy.
+		PartitionAssignmentStrategy AssignmentStrategy
+		// RebalanceDelay is how long the zookeeper backend waits after a
+		// local topic list change before registering it, to coalesce
+		// bursts of calls to `Topics()`.
+		RebalanceDelay time.Duration
+		// PartitionWatchInterval is how often a group member polls a
+		// subscribed topic for a partition count change.
+		PartitionWatchInterval time.Duration
+	}
+}
+
+// Default returns a configuration populated with kafka-pixy's defaults.
+// Callers override individual fields for their environment.
+func Default() *T {
+	c := &T{}
+	c.Kafka.Version = sarama.V0_10_0_0
+	c.Consumer.Coordinator = CoordinatorZooKeeper
+	c.Consumer.BalanceStrategy = BalanceStrategyEager
+	c.Consumer.PartitionAssignmentStrategy = AssignmentStrategyRange
+	c.Consumer.RebalanceDelay = 250 * time.Millisecond
+	c.Consumer.PartitionWatchInterval = 30 * time.Second
+	return c
+}
+
+// BrokerAddrs returns the `host:port` addresses kafka-pixy connects to the
+// Kafka cluster through.
+func (c *T) BrokerAddrs() []string {
+	return c.Kafka.SeedPeers
+}
+
+// SaramaClientCfg returns the sarama client configuration kafka-pixy uses
+// to talk to the brokers returned by BrokerAddrs.
+func (c *T) SaramaClientCfg() *sarama.Config {
+	cfg := sarama.NewConfig()
+	cfg.ClientID = c.ClientID
+	cfg.Version = c.Kafka.Version
+	return cfg
+}
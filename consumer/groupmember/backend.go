@@ -0,0 +1,55 @@
+package groupmember
+
+import (
+	"github.com/mailgun/kafka-pixy/actor"
+	"github.com/mailgun/kafka-pixy/none"
+)
+
+// Backend abstracts away the mechanics of consumer group membership and
+// partition ownership tracking, so that `T` can be driven either by the
+// legacy ZooKeeper `/consumers` tree (`zkBackend`) or by a native Kafka
+// group coordinator (`kafkaBackend`). Both implementations expose the same
+// membership/subscription/claim semantics the rest of the consumer package
+// relies on, regardless of where group state actually lives.
+type Backend interface {
+	// Join registers memberID with the group and starts consuming topic
+	// subscription requests off topicsCh. The returned channel receives a
+	// fresh `{member -> topics}` snapshot every time the resolved
+	// subscription of any group member changes. The channel is closed once
+	// Stop returns.
+	Join(memberID string, topicsCh <-chan []string) <-chan map[string][]string
+
+	// ClaimPartition claims ownership of topic/partition on behalf of the
+	// member that called Join. It blocks until the claim succeeds or
+	// cancelCh is closed, in which case it returns a no-op release
+	// function. Otherwise the returned function releases the claim.
+	ClaimPartition(cid *actor.ID, topic string, partition int32, cancelCh <-chan none.T) func()
+
+	// Stop deregisters the member and releases all resources held by the
+	// backend. It blocks until shutdown is complete.
+	Stop()
+
+	// ListTopics returns the full list of topics currently known to the
+	// cluster. It is used to materialize a regex/whitelist/blacklist
+	// Subscription into a concrete topic list.
+	ListTopics() ([]string, error)
+
+	// AssignedPartitions returns the partitions of topic that the group's
+	// sticky assignment plan currently grants to the member that called
+	// Join. It only returns a non-empty result when
+	// `cfg.Consumer.PartitionAssignmentStrategy` is
+	// `config.AssignmentStrategySticky`; other strategies leave partition
+	// ownership to whichever member calls ClaimPartition first.
+	AssignedPartitions(topic string) []int32
+
+	// Ack asks the backend to redeliver its current `{member -> topics}`
+	// view on the channel returned by Join at least once more, bypassing
+	// any dedup the backend applies to suppress redundant republishing.
+	// `T.run` calls this right after handing a cooperative-sticky revoke
+	// Notification to its caller: the backend's view is already the
+	// settled post-rebalance state (it is this member's own prior calls to
+	// Topics that produced it), so nothing would otherwise ever deliver it
+	// a second time for the pending-assign equality gate in `run` to
+	// match against. It is a no-op once Stop has been called.
+	Ack()
+}
@@ -0,0 +1,512 @@
+// Package groupmember implements registration of a consumer group member
+// and tracking of the group's aggregate topic subscriptions and partition
+// ownership.
+package groupmember
+
+import (
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mailgun/kafka-pixy/actor"
+	"github.com/mailgun/kafka-pixy/config"
+	"github.com/mailgun/kafka-pixy/none"
+	"github.com/wvanbergen/kazoo-go"
+)
+
+// T maintains membership of a consumer group member and notifies the owner
+// of the group's actual topic subscriptions as they change. It also
+// arbitrates ownership of individual topic partitions among group members
+// via `ClaimPartition`.
+//
+// T itself is agnostic of where group membership and ownership state lives:
+// that is delegated to a `Backend` implementation chosen by `Spawn` based on
+// `config.T.Consumer.Coordinator`.
+type T struct {
+	actorID    *actor.ID
+	cfg        *config.T
+	group      string
+	memberID   string
+	backend    Backend
+	groupZNode *kazoo.Consumergroup // set only when running with the zookeeper backend, nil otherwise.
+
+	topicsCh         chan []string
+	patternsCh       chan Subscription
+	internalTopicsCh chan []string
+	subscriptionsCh  chan Notification
+	stopCh           chan none.T
+	wg               sync.WaitGroup
+}
+
+// Pattern selects how a Subscription's Expr is interpreted.
+type Pattern int
+
+const (
+	// PatternStatic subscribes to the single literal topic name in Expr.
+	PatternStatic Pattern = iota
+	// PatternWhiteList subscribes to every cluster topic whose name
+	// matches the regular expression in Expr.
+	PatternWhiteList
+	// PatternBlackList subscribes to every cluster topic whose name does
+	// NOT match the regular expression in Expr.
+	PatternBlackList
+)
+
+// Subscription is sent on `Patterns()` to subscribe to a dynamically
+// resolved set of topics instead of the static list `Topics()` accepts.
+// Pattern/Expr mirror the `static`/`white_list`/`black_list` modes kazoo
+// already persists in the `Registration` znode. The registrator
+// periodically re-evaluates Expr against the broker's topic list (see
+// `cfg.Consumer.PartitionWatchInterval`) and republishes a subscription
+// update whenever the resolved set changes.
+type Subscription struct {
+	Pattern Pattern
+	Expr    string
+}
+
+// Notification is what a group member registrator publishes on
+// `Subscriptions()`. `Subscriptions` is always the group's full current
+// `{member -> topics}` snapshot. `Revoked` and `Assigned` are only
+// populated when `cfg.Consumer.BalanceStrategy` is
+// `config.BalanceStrategyCooperativeSticky`: on such a rebalance a member
+// first receives `Revoked`, listing per member the topics it must stop
+// consuming, and then `Assigned`, once its own backend has redelivered the
+// settled snapshot. Members do not wait for each other between the two
+// phases. Members whose assignment did not change never see it churn.
+type Notification struct {
+	Subscriptions map[string][]string
+	Revoked       map[string][]string
+	Assigned      map[string][]string
+}
+
+// Spawn creates a group member registrator and starts its actor goroutine.
+// `kazooConn` is used by the zookeeper backend to talk to the `/consumers`
+// tree; it is ignored when `cfg.Consumer.Coordinator` selects the kafka
+// backend, but callers that also run other ZooKeeper backed components may
+// pass it unconditionally.
+func Spawn(group, memberID string, cfg *config.T, kazooConn *kazoo.Kazoo) *T {
+	gm := &T{
+		actorID:          actor.RootID.NewChild("gm", group, memberID),
+		cfg:              cfg,
+		group:            group,
+		memberID:         memberID,
+		topicsCh:         make(chan []string),
+		patternsCh:       make(chan Subscription),
+		internalTopicsCh: make(chan []string),
+		subscriptionsCh:  make(chan Notification),
+		stopCh:           make(chan none.T),
+	}
+
+	if cfg.Consumer.Coordinator == config.CoordinatorKafka {
+		gm.backend = newKafkaBackend(gm.actorID, group, cfg)
+	} else {
+		zk := newZKBackend(gm.actorID, group, cfg, kazooConn)
+		gm.groupZNode = zk.groupZNode
+		gm.backend = zk
+	}
+
+	gm.wg.Add(1)
+	go gm.run()
+	return gm
+}
+
+// Topics returns the channel the caller should send its current list of
+// subscribed topics to. An empty or nil list unsubscribes from all topics.
+// Sending on Topics cancels a Subscription previously sent on Patterns.
+func (gm *T) Topics() chan<- []string {
+	return gm.topicsCh
+}
+
+// Patterns returns the channel the caller should send a Subscription to, to
+// subscribe to a regex/whitelist/blacklist resolved set of topics instead
+// of a static list. Sending on Patterns cancels a previous static
+// subscription sent on Topics.
+func (gm *T) Patterns() chan<- Subscription {
+	return gm.patternsCh
+}
+
+// Subscriptions returns the channel that receives a Notification every time
+// the group's subscriptions change. Under the default `eager` balance
+// strategy each Notification simply carries the new full snapshot; under
+// `cooperative-sticky` a rebalance that revokes any member's topics is
+// split into a revoke Notification followed by an assign one for every
+// member whose own topics it revokes or assigns, while other members get
+// the settled snapshot in a single Notification, see Notification for
+// details.
+func (gm *T) Subscriptions() <-chan Notification {
+	return gm.subscriptionsCh
+}
+
+// ClaimPartition claims ownership of topic/partition for this member. It
+// blocks until the claim succeeds or cancelCh is closed, and returns a
+// function that releases the claim.
+func (gm *T) ClaimPartition(cid *actor.ID, topic string, partition int32, cancelCh <-chan none.T) func() {
+	return gm.backend.ClaimPartition(cid, topic, partition, cancelCh)
+}
+
+// AssignedPartitions returns the partitions of topic that the group's sticky
+// assignment plan currently grants to this member, so that callers only
+// attempt to `ClaimPartition` those instead of racing for all of them. It is
+// only meaningful when `cfg.Consumer.PartitionAssignmentStrategy` is
+// `config.AssignmentStrategySticky`; other strategies always return nil,
+// leaving the choice of what to claim entirely up to the caller.
+func (gm *T) AssignedPartitions(topic string) []int32 {
+	return gm.backend.AssignedPartitions(topic)
+}
+
+// Stop deregisters the member from the group and releases all resources
+// associated with it. It blocks until shutdown is complete.
+func (gm *T) Stop() {
+	close(gm.stopCh)
+	gm.wg.Wait()
+}
+
+func (gm *T) run() {
+	defer gm.wg.Done()
+	defer gm.backend.Stop()
+
+	subscriptionsInCh := gm.backend.Join(gm.memberID, gm.internalTopicsCh)
+	var prev map[string][]string
+	var pendingAssign *Notification
+
+	watchInterval := gm.cfg.Consumer.PartitionWatchInterval
+	if watchInterval <= 0 {
+		watchInterval = defaultPartitionWatchInterval
+	}
+	var pattern *regexp.Regexp
+	var patternMode Pattern
+	var lastResolved []string
+	var resolveTicker *time.Ticker
+	var resolveTickerCh <-chan time.Time
+	stopResolving := func() {
+		if resolveTicker != nil {
+			resolveTicker.Stop()
+			resolveTicker = nil
+			resolveTickerCh = nil
+		}
+		pattern = nil
+	}
+	defer stopResolving()
+
+	for {
+		select {
+		case topics := <-gm.topicsCh:
+			stopResolving()
+			select {
+			case gm.internalTopicsCh <- topics:
+			case <-gm.stopCh:
+				return
+			}
+
+		case sub := <-gm.patternsCh:
+			re, err := compileSubscription(sub)
+			if err != nil {
+				continue
+			}
+			pattern, patternMode = re, sub.Pattern
+			lastResolved = nil
+			if resolveTicker == nil {
+				resolveTicker = time.NewTicker(watchInterval)
+				resolveTickerCh = resolveTicker.C
+			}
+			gm.resolvePattern(pattern, patternMode, &lastResolved, true)
+
+		case <-resolveTickerCh:
+			gm.resolvePattern(pattern, patternMode, &lastResolved, false)
+
+		case next, ok := <-subscriptionsInCh:
+			if !ok {
+				return
+			}
+
+			var notification Notification
+			ackPendingAssign := false
+			switch {
+			case pendingAssign != nil && subscriptionsEqual(next, pendingAssign.Subscriptions):
+				// The backend has redelivered the snapshot the revoke was
+				// planned against (forced by the Ack below): publish the
+				// assign phase computed alongside it. This does not wait
+				// for other members to acknowledge their revokes.
+				notification = *pendingAssign
+				pendingAssign = nil
+			default:
+				revoke, assign := gm.planCooperativeRebalance(prev, next)
+				switch {
+				case revoke == nil:
+					notification = Notification{Subscriptions: next}
+				case len(revoke.Revoked[gm.memberID]) == 0 && len(assign.Assigned[gm.memberID]) == 0:
+					// This member's own subscription is untouched by the
+					// rebalance: publish the settled state directly instead of
+					// dragging it through the revoke/ack round trip other
+					// members are going through.
+					notification = *assign
+				default:
+					notification = *revoke
+					pendingAssign = assign
+					ackPendingAssign = true
+				}
+			}
+
+			select {
+			case gm.subscriptionsCh <- notification:
+			case <-gm.stopCh:
+				return
+			}
+			prev = next
+
+			if ackPendingAssign {
+				// next is already the settled state the backend derived
+				// from this member's own prior registration, so nothing is
+				// ever going to deliver it again on its own once the
+				// backend's dedup has suppressed the unchanged snapshot.
+				// Ack forces exactly that redelivery, which is what lets
+				// the pending-assign gate above match and publish the
+				// assign phase.
+				gm.backend.Ack()
+			}
+
+		case <-gm.stopCh:
+			return
+		}
+	}
+}
+
+// compileSubscription validates and compiles a Subscription's Expr. For
+// PatternStatic, Expr is taken as a literal topic name and matched via an
+// anchored exact-match expression.
+func compileSubscription(sub Subscription) (*regexp.Regexp, error) {
+	expr := sub.Expr
+	if sub.Pattern == PatternStatic {
+		expr = "^" + regexp.QuoteMeta(sub.Expr) + "$"
+	}
+	return regexp.Compile(expr)
+}
+
+// resolvePattern re-evaluates pattern against the broker's current topic
+// list and, if the resolved set changed since *lastResolved or force is
+// set, forwards it to the backend as a fresh static subscription.
+func (gm *T) resolvePattern(pattern *regexp.Regexp, mode Pattern, lastResolved *[]string, force bool) {
+	if pattern == nil {
+		return
+	}
+	allTopics, err := gm.backend.ListTopics()
+	if err != nil {
+		return
+	}
+	var resolved []string
+	for _, topic := range allTopics {
+		matched := pattern.MatchString(topic)
+		if mode == PatternBlackList {
+			matched = !matched
+		}
+		if matched {
+			resolved = append(resolved, topic)
+		}
+	}
+	resolved = normalizeTopics(resolved)
+	if !force && topicsEqual(resolved, *lastResolved) {
+		return
+	}
+	*lastResolved = resolved
+	select {
+	case gm.internalTopicsCh <- resolved:
+	case <-gm.stopCh:
+	}
+}
+
+// planCooperativeRebalance computes the revoke-phase Notification and the
+// Notification pending its acknowledgement for a membership change from
+// prev to next, when running with the cooperative-sticky balance strategy.
+// It returns (nil, nil) when the strategy is `eager` or nothing needs to be
+// revoked, meaning the caller should publish next as a single Notification.
+func (gm *T) planCooperativeRebalance(prev, next map[string][]string) (revoke, pendingAssign *Notification) {
+	if gm.cfg.Consumer.BalanceStrategy != config.BalanceStrategyCooperativeSticky {
+		return nil, nil
+	}
+
+	revoked := make(map[string][]string)
+	assigned := make(map[string][]string)
+	for member, newTopics := range next {
+		oldTopics := prev[member]
+		if r := topicsDiff(oldTopics, newTopics); len(r) > 0 {
+			revoked[member] = r
+		}
+		if a := topicsDiff(newTopics, oldTopics); len(a) > 0 {
+			assigned[member] = a
+		}
+	}
+	for member, oldTopics := range prev {
+		if _, stillMember := next[member]; !stillMember {
+			if r := normalizeTopics(oldTopics); len(r) > 0 {
+				revoked[member] = r
+			}
+		}
+	}
+	if len(revoked) == 0 {
+		return nil, nil
+	}
+
+	// The revoke phase only ever shows a member the topics it already had:
+	// newly assigned topics stay hidden until their previous owner has
+	// acknowledged giving them up.
+	revokePhase := make(map[string][]string, len(next))
+	for member := range next {
+		revokePhase[member] = topicsDiff(prev[member], revoked[member])
+	}
+	return &Notification{Subscriptions: revokePhase, Revoked: revoked},
+		&Notification{Subscriptions: next, Assigned: assigned}
+}
+
+// planPartitionAssignment computes a `{partition -> member}` assignment for
+// partitions among members, preferring to leave a partition with the member
+// prevOwners records for it when that member is still present, so that only
+// the partitions of members who left (or the minimum needed to rebalance a
+// newly joined member in) actually move. It is used when
+// `cfg.Consumer.PartitionAssignmentStrategy` is
+// `config.AssignmentStrategySticky`.
+func planPartitionAssignment(partitions []int32, members []string, prevOwners map[int32]string) map[int32]string {
+	assignment := make(map[int32]string, len(partitions))
+	if len(members) == 0 || len(partitions) == 0 {
+		return assignment
+	}
+
+	sortedMembers := append([]string(nil), members...)
+	sort.Strings(sortedMembers)
+	isMember := make(map[string]bool, len(sortedMembers))
+	for _, member := range sortedMembers {
+		isMember[member] = true
+	}
+
+	sortedPartitions := append([]int32(nil), partitions...)
+	sort.Slice(sortedPartitions, func(i, j int) bool { return sortedPartitions[i] < sortedPartitions[j] })
+
+	owned := make(map[string][]int32, len(sortedMembers))
+	var unassigned []int32
+	for _, partition := range sortedPartitions {
+		if owner, ok := prevOwners[partition]; ok && isMember[owner] {
+			assignment[partition] = owner
+			owned[owner] = append(owned[owner], partition)
+		} else {
+			unassigned = append(unassigned, partition)
+		}
+	}
+
+	// target is how many partitions a balanced assignment gives each member:
+	// the first `len(partitions) % len(members)` members (in sorted order)
+	// get one extra, so the counts differ by at most one.
+	target := make(map[string]int, len(sortedMembers))
+	base, extra := len(sortedPartitions)/len(sortedMembers), len(sortedPartitions)%len(sortedMembers)
+	for i, member := range sortedMembers {
+		target[member] = base
+		if i < extra {
+			target[member]++
+		}
+	}
+
+	leastLoaded := func() string {
+		best := sortedMembers[0]
+		for _, member := range sortedMembers[1:] {
+			if len(owned[member]) < len(owned[best]) {
+				best = member
+			}
+		}
+		return best
+	}
+	for _, partition := range unassigned {
+		member := leastLoaded()
+		assignment[partition] = member
+		owned[member] = append(owned[member], partition)
+	}
+
+	// Rebalance: a newly joined member starts out under its target while an
+	// existing member that kept all its old partitions may now be over it.
+	// Move the minimum number of partitions to close that gap, taking the
+	// highest partition IDs first so the choice is deterministic.
+	for {
+		over, under := "", ""
+		for _, member := range sortedMembers {
+			if len(owned[member]) > target[member] && (over == "" || len(owned[member]) > len(owned[over])) {
+				over = member
+			}
+			if len(owned[member]) < target[member] && (under == "" || len(owned[member]) < len(owned[under])) {
+				under = member
+			}
+		}
+		if over == "" || under == "" {
+			break
+		}
+		list := owned[over]
+		moved := list[len(list)-1]
+		owned[over] = list[:len(list)-1]
+		owned[under] = append(owned[under], moved)
+		assignment[moved] = under
+	}
+
+	return assignment
+}
+
+// topicsDiff returns the normalized topics present in a but not in b.
+func topicsDiff(a, b []string) []string {
+	inB := make(map[string]bool, len(b))
+	for _, topic := range b {
+		inB[topic] = true
+	}
+	var diff []string
+	for _, topic := range a {
+		if !inB[topic] {
+			diff = append(diff, topic)
+		}
+	}
+	return normalizeTopics(diff)
+}
+
+// normalizeTopics returns a sorted copy of topics with duplicates removed,
+// or nil if topics is empty.
+func normalizeTopics(topics []string) []string {
+	if len(topics) == 0 {
+		return nil
+	}
+	seen := make(map[string]bool, len(topics))
+	normalized := make([]string, 0, len(topics))
+	for _, topic := range topics {
+		if seen[topic] {
+			continue
+		}
+		seen[topic] = true
+		normalized = append(normalized, topic)
+	}
+	sort.Strings(normalized)
+	return normalized
+}
+
+// topicsEqual returns true if a and b contain the same topics in the same
+// order. Callers that do not care about order should normalize both sides
+// with normalizeTopics first.
+func topicsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// subscriptionsEqual returns true if a and b list the same group members
+// subscribed to the same topics. Topic lists are compared with topicsEqual,
+// so callers should only pass already normalized subscription maps.
+func subscriptionsEqual(a, b map[string][]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for member, aTopics := range a {
+		bTopics, ok := b[member]
+		if !ok || !topicsEqual(aTopics, bTopics) {
+			return false
+		}
+	}
+	return true
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/mailgun/kafka-pixy/config"
 	"github.com/mailgun/kafka-pixy/none"
 	"github.com/mailgun/kafka-pixy/testhelpers"
+	"github.com/mailgun/sarama"
 	"github.com/wvanbergen/kazoo-go"
 	. "gopkg.in/check.v1"
 )
@@ -81,7 +82,7 @@ func (s *GroupRegistratorSuite) TestSimpleSubscribe(c *C) {
 	gm.Topics() <- []string{"foo", "bar"}
 
 	// Then
-	c.Assert(<-gm.Subscriptions(), DeepEquals,
+	c.Assert((<-gm.Subscriptions()).Subscriptions, DeepEquals,
 		map[string][]string{"m1": {"bar", "foo"}})
 }
 
@@ -100,7 +101,7 @@ func (s *GroupRegistratorSuite) TestSubscribeSequence(c *C) {
 	gm.Topics() <- []string{"blah", "bazz"}
 
 	// Then
-	c.Assert(<-gm.Subscriptions(), DeepEquals,
+	c.Assert((<-gm.Subscriptions()).Subscriptions, DeepEquals,
 		map[string][]string{"m1": {"bazz", "blah"}})
 }
 
@@ -123,8 +124,8 @@ func (s *GroupRegistratorSuite) TestReSubscribe(c *C) {
 		"m1": {"bar", "foo"},
 		"m2": {"bar", "bazz"},
 	}
-	c.Assert(<-gm1.Subscriptions(), DeepEquals, membership)
-	c.Assert(<-gm2.Subscriptions(), DeepEquals, membership)
+	c.Assert((<-gm1.Subscriptions()).Subscriptions, DeepEquals, membership)
+	c.Assert((<-gm2.Subscriptions()).Subscriptions, DeepEquals, membership)
 
 	// When
 	gm1.Topics() <- []string{"foo", "bar"}
@@ -150,16 +151,16 @@ func (s *GroupRegistratorSuite) TestSubscribeToNothing(c *C) {
 	defer gm2.Stop()
 	gm1.Topics() <- []string{"foo", "bar"}
 	gm2.Topics() <- []string{"foo"}
-	c.Assert(<-gm1.Subscriptions(), DeepEquals,
+	c.Assert((<-gm1.Subscriptions()).Subscriptions, DeepEquals,
 		map[string][]string{"m1": {"bar", "foo"}, "m2": {"foo"}})
-	c.Assert(<-gm2.Subscriptions(), DeepEquals,
+	c.Assert((<-gm2.Subscriptions()).Subscriptions, DeepEquals,
 		map[string][]string{"m1": {"bar", "foo"}, "m2": {"foo"}})
 
 	// When
 	gm1.Topics() <- []string{}
 
 	// Then
-	c.Assert(<-gm2.Subscriptions(), DeepEquals,
+	c.Assert((<-gm2.Subscriptions()).Subscriptions, DeepEquals,
 		map[string][]string{"m2": {"foo"}})
 	select {
 	case update := <-gm1.Subscriptions():
@@ -179,16 +180,16 @@ func (s *GroupRegistratorSuite) TestSubscribeToNil(c *C) {
 	defer gm2.Stop()
 	gm1.Topics() <- []string{"foo", "bar"}
 	gm2.Topics() <- []string{"foo"}
-	c.Assert(<-gm1.Subscriptions(), DeepEquals,
+	c.Assert((<-gm1.Subscriptions()).Subscriptions, DeepEquals,
 		map[string][]string{"m1": {"bar", "foo"}, "m2": {"foo"}})
-	c.Assert(<-gm2.Subscriptions(), DeepEquals,
+	c.Assert((<-gm2.Subscriptions()).Subscriptions, DeepEquals,
 		map[string][]string{"m1": {"bar", "foo"}, "m2": {"foo"}})
 
 	// When
 	gm1.Topics() <- nil
 
 	// Then
-	c.Assert(<-gm2.Subscriptions(), DeepEquals,
+	c.Assert((<-gm2.Subscriptions()).Subscriptions, DeepEquals,
 		map[string][]string{"m2": {"foo"}})
 	select {
 	case update := <-gm1.Subscriptions():
@@ -222,9 +223,9 @@ func (s *GroupRegistratorSuite) TestMembershipChanges(c *C) {
 		"m2": {"foo"},
 		"m3": {"bazz", "blah", "foo"}}
 
-	c.Assert(<-gm1.Subscriptions(), DeepEquals, membership)
-	c.Assert(<-gm2.Subscriptions(), DeepEquals, membership)
-	c.Assert(<-gm3.Subscriptions(), DeepEquals, membership)
+	c.Assert((<-gm1.Subscriptions()).Subscriptions, DeepEquals, membership)
+	c.Assert((<-gm2.Subscriptions()).Subscriptions, DeepEquals, membership)
+	c.Assert((<-gm3.Subscriptions()).Subscriptions, DeepEquals, membership)
 }
 
 // When one of the group members generates a rapid sequence of subscription
@@ -242,7 +243,7 @@ func (s *GroupRegistratorSuite) TestRedundantUpdateIgnored(c *C) {
 	gm1.Topics() <- []string{"foo", "bar"}
 	gm2.Topics() <- []string{"foo", "bazz", "blah"}
 
-	c.Assert(<-gm1.Subscriptions(), DeepEquals,
+	c.Assert((<-gm1.Subscriptions()).Subscriptions, DeepEquals,
 		map[string][]string{
 			"m1": {"bar", "foo"},
 			"m2": {"bazz", "blah", "foo"}})
@@ -259,6 +260,406 @@ func (s *GroupRegistratorSuite) TestRedundantUpdateIgnored(c *C) {
 	}
 }
 
+// If a subscribed topic's partition count grows, the group receives a fresh
+// notification for the same membership so that partition consumers can
+// claim the new partitions, even though the set of subscribed topics has
+// not changed.
+func (s *GroupRegistratorSuite) TestPartitionCountChangeTriggersNotification(c *C) {
+	// Given
+	cfg := config.Default()
+	cfg.Consumer.RebalanceDelay = 100 * time.Millisecond
+	cfg.Consumer.PartitionWatchInterval = 100 * time.Millisecond
+	gm := Spawn("gm_test", "m1", cfg, s.kazooConn)
+	defer gm.Stop()
+
+	gm.Topics() <- []string{"test.4"}
+	c.Assert((<-gm.Subscriptions()).Subscriptions, DeepEquals,
+		map[string][]string{"m1": {"test.4"}})
+
+	admin, err := sarama.NewClusterAdmin(testhelpers.KafkaPeers, sarama.NewConfig())
+	c.Assert(err, IsNil)
+	defer admin.Close()
+
+	// When
+	c.Assert(admin.CreatePartitions("test.4", 8, nil, false), IsNil)
+
+	// Then
+	select {
+	case notification := <-gm.Subscriptions():
+		c.Assert(notification.Subscriptions, DeepEquals,
+			map[string][]string{"m1": {"test.4"}})
+	case <-time.After(3 * time.Second):
+		c.Error("Timed out waiting for a partition count change notification")
+	}
+}
+
+// A whitelist Subscription sent on Patterns() resolves to every cluster
+// topic whose name matches Expr.
+func (s *GroupRegistratorSuite) TestPatternSubscribeWhiteList(c *C) {
+	// Given
+	admin, err := sarama.NewClusterAdmin(testhelpers.KafkaPeers, sarama.NewConfig())
+	c.Assert(err, IsNil)
+	defer admin.Close()
+	c.Assert(admin.CreateTopic("gm.pattern.a", &sarama.TopicDetail{NumPartitions: 1, ReplicationFactor: 1}, false), IsNil)
+
+	cfg := config.Default()
+	cfg.Consumer.RebalanceDelay = 100 * time.Millisecond
+	cfg.Consumer.PartitionWatchInterval = 100 * time.Millisecond
+	gm := Spawn("gm_test", "m1", cfg, s.kazooConn)
+	defer gm.Stop()
+
+	// When
+	gm.Patterns() <- Subscription{Pattern: PatternWhiteList, Expr: "^gm\\.pattern\\.[^.]+$"}
+
+	// Then
+	notification := <-gm.Subscriptions()
+	c.Assert(notification.Subscriptions["m1"], DeepEquals, []string{"gm.pattern.a"})
+}
+
+// A Subscription whose Expr matches no cluster topic resolves to an empty
+// subscription.
+func (s *GroupRegistratorSuite) TestPatternSubscribeEmpty(c *C) {
+	// Given
+	cfg := config.Default()
+	cfg.Consumer.RebalanceDelay = 100 * time.Millisecond
+	cfg.Consumer.PartitionWatchInterval = 100 * time.Millisecond
+	gm := Spawn("gm_test", "m1", cfg, s.kazooConn)
+	defer gm.Stop()
+
+	// When
+	gm.Patterns() <- Subscription{Pattern: PatternWhiteList, Expr: "^gm\\.pattern\\.nonexistent\\..*$"}
+
+	// Then
+	select {
+	case update := <-gm.Subscriptions():
+		c.Errorf("Unexpected update: %v", update)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+// When a new topic matching an active whitelist Subscription is created,
+// the resolved set grows and a fresh notification is published.
+func (s *GroupRegistratorSuite) TestPatternSubscribeGrows(c *C) {
+	// Given
+	admin, err := sarama.NewClusterAdmin(testhelpers.KafkaPeers, sarama.NewConfig())
+	c.Assert(err, IsNil)
+	defer admin.Close()
+	c.Assert(admin.CreateTopic("gm.pattern.grows.a", &sarama.TopicDetail{NumPartitions: 1, ReplicationFactor: 1}, false), IsNil)
+
+	cfg := config.Default()
+	cfg.Consumer.RebalanceDelay = 100 * time.Millisecond
+	cfg.Consumer.PartitionWatchInterval = 100 * time.Millisecond
+	gm := Spawn("gm_test", "m1", cfg, s.kazooConn)
+	defer gm.Stop()
+	gm.Patterns() <- Subscription{Pattern: PatternWhiteList, Expr: "^gm\\.pattern\\.grows\\..*$"}
+	c.Assert((<-gm.Subscriptions()).Subscriptions["m1"], DeepEquals, []string{"gm.pattern.grows.a"})
+
+	// When
+	c.Assert(admin.CreateTopic("gm.pattern.grows.b", &sarama.TopicDetail{NumPartitions: 1, ReplicationFactor: 1}, false), IsNil)
+
+	// Then
+	select {
+	case notification := <-gm.Subscriptions():
+		c.Assert(notification.Subscriptions["m1"], DeepEquals,
+			[]string{"gm.pattern.grows.a", "gm.pattern.grows.b"})
+	case <-time.After(3 * time.Second):
+		c.Error("Timed out waiting for the pattern to pick up the new topic")
+	}
+}
+
+// Submitting a static topic list on Topics() overrides and cancels a
+// previously active Patterns() subscription.
+func (s *GroupRegistratorSuite) TestPatternSwitchToStatic(c *C) {
+	// Given
+	cfg := config.Default()
+	cfg.Consumer.RebalanceDelay = 100 * time.Millisecond
+	cfg.Consumer.PartitionWatchInterval = 100 * time.Millisecond
+	gm := Spawn("gm_test", "m1", cfg, s.kazooConn)
+	defer gm.Stop()
+	gm.Patterns() <- Subscription{Pattern: PatternWhiteList, Expr: "^gm\\.pattern\\..*$"}
+	<-gm.Subscriptions()
+
+	// When
+	gm.Topics() <- []string{"static.only"}
+
+	// Then
+	c.Assert((<-gm.Subscriptions()).Subscriptions, DeepEquals,
+		map[string][]string{"m1": {"static.only"}})
+}
+
+// planCooperativeRebalance returns (nil, nil) under the default eager
+// balance strategy, regardless of what changed.
+func (s *GroupRegistratorSuite) TestPlanCooperativeRebalanceEager(c *C) {
+	// Given
+	gm := &T{cfg: config.Default()}
+	prev := map[string][]string{"m1": {"foo"}}
+	next := map[string][]string{"m1": {"foo", "bar"}}
+
+	// When/Then
+	revoke, pendingAssign := gm.planCooperativeRebalance(prev, next)
+	c.Assert(revoke, IsNil)
+	c.Assert(pendingAssign, IsNil)
+}
+
+// When a member joins or grows its subscription without anyone losing
+// topics, cooperative-sticky mode has nothing to revoke: the caller
+// publishes next as a single Notification.
+func (s *GroupRegistratorSuite) TestPlanCooperativeRebalanceNoRevoke(c *C) {
+	// Given
+	cfg := config.Default()
+	cfg.Consumer.BalanceStrategy = config.BalanceStrategyCooperativeSticky
+	gm := &T{cfg: cfg}
+	prev := map[string][]string{"m1": {"foo"}}
+	next := map[string][]string{"m1": {"foo"}, "m2": {"bar"}}
+
+	// When/Then
+	revoke, pendingAssign := gm.planCooperativeRebalance(prev, next)
+	c.Assert(revoke, IsNil)
+	c.Assert(pendingAssign, IsNil)
+}
+
+// When a member is dropped from the group, cooperative-sticky mode revokes
+// its topics from it in the first phase, and leaves every other member's
+// share of the revoke phase untouched.
+func (s *GroupRegistratorSuite) TestPlanCooperativeRebalanceRevoke(c *C) {
+	// Given
+	cfg := config.Default()
+	cfg.Consumer.BalanceStrategy = config.BalanceStrategyCooperativeSticky
+	gm := &T{cfg: cfg}
+	prev := map[string][]string{
+		"m1": {"foo", "bar"},
+		"m2": {"bazz"},
+	}
+	next := map[string][]string{
+		"m1": {"foo", "bar", "bazz"},
+	}
+
+	// When
+	revoke, pendingAssign := gm.planCooperativeRebalance(prev, next)
+
+	// Then: m1's unaffected topics are unchanged in the revoke phase, and
+	// the newly assigned `bazz` only shows up once the revoke is acked.
+	c.Assert(revoke, DeepEquals, &Notification{
+		Subscriptions: map[string][]string{"m1": {"bar", "foo"}},
+		Revoked:       map[string][]string{"m2": {"bazz"}},
+	})
+	c.Assert(pendingAssign, DeepEquals, &Notification{
+		Subscriptions: next,
+		Assigned:      map[string][]string{"m1": {"bazz"}},
+	})
+}
+
+// When one member of a cooperative-sticky group leaves, members whose own
+// subscription is untouched by the rebalance never see the intermediate
+// revoke notification: they get the settled state directly, with nothing to
+// ack.
+func (s *GroupRegistratorSuite) TestCooperativeRebalanceUnaffectedMemberSkipsRevoke(c *C) {
+	// Given
+	cfg := config.Default()
+	cfg.Consumer.RebalanceDelay = 100 * time.Millisecond
+	cfg.Consumer.BalanceStrategy = config.BalanceStrategyCooperativeSticky
+	gm1 := Spawn("gm_cooperative_test", "m1", cfg, s.kazooConn)
+	defer gm1.Stop()
+	gm2 := Spawn("gm_cooperative_test", "m2", cfg, s.kazooConn)
+	defer gm2.Stop()
+	gm3 := Spawn("gm_cooperative_test", "m3", cfg, s.kazooConn)
+
+	gm1.Topics() <- []string{"foo"}
+	gm2.Topics() <- []string{"bar"}
+	gm3.Topics() <- []string{"bazz"}
+	<-gm1.Subscriptions()
+	<-gm2.Subscriptions()
+	<-gm3.Subscriptions()
+
+	// When: m3 leaves the group.
+	gm3.Stop()
+
+	// Then: m1 and m2 each settle on the group without m3 in a single
+	// notification, with nothing revoked from them to ack.
+	settled := map[string][]string{"m1": {"foo"}, "m2": {"bar"}}
+
+	n1 := <-gm1.Subscriptions()
+	c.Assert(n1.Subscriptions, DeepEquals, settled)
+	c.Assert(n1.Revoked, IsNil)
+
+	n2 := <-gm2.Subscriptions()
+	c.Assert(n2.Subscriptions, DeepEquals, settled)
+	c.Assert(n2.Revoked, IsNil)
+
+	select {
+	case update := <-gm1.Subscriptions():
+		c.Errorf("Unexpected intermediate update: %v", update)
+	case <-time.After(300 * time.Millisecond):
+	}
+	select {
+	case update := <-gm2.Subscriptions():
+		c.Errorf("Unexpected intermediate update: %v", update)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+// When a topic moves from one still-present cooperative-sticky member to
+// another, the losing member settles on giving it up and the gaining member
+// eventually receives it once its pending-assign gate fires — it does not
+// get stuck on the revoke-phase view forever, because the backend acks the
+// gaining member's own registration on its behalf.
+func (s *GroupRegistratorSuite) TestCooperativeRebalanceTopicMovesBetweenMembers(c *C) {
+	// Given
+	cfg := config.Default()
+	cfg.Consumer.RebalanceDelay = 100 * time.Millisecond
+	cfg.Consumer.BalanceStrategy = config.BalanceStrategyCooperativeSticky
+	gm1 := Spawn("gm_cooperative_move_test", "m1", cfg, s.kazooConn)
+	defer gm1.Stop()
+	gm2 := Spawn("gm_cooperative_move_test", "m2", cfg, s.kazooConn)
+	defer gm2.Stop()
+
+	gm1.Topics() <- []string{"foo", "shared"}
+	gm2.Topics() <- []string{"bar"}
+	<-gm1.Subscriptions()
+	<-gm2.Subscriptions()
+
+	// When: "shared" moves from m1 to m2.
+	gm1.Topics() <- []string{"foo"}
+	gm2.Topics() <- []string{"bar", "shared"}
+
+	// Then: both members eventually settle on the new owner of "shared",
+	// even though the intermediate revoke-phase notification they may see
+	// along the way still shows it withheld from m2.
+	settled := map[string][]string{"m1": {"foo"}, "m2": {"bar", "shared"}}
+	n1 := waitForSettledSubscriptions(c, gm1.Subscriptions(), "m1", []string{"foo"})
+	c.Assert(n1.Subscriptions, DeepEquals, settled)
+	n2 := waitForSettledSubscriptions(c, gm2.Subscriptions(), "m2", []string{"bar", "shared"})
+	c.Assert(n2.Subscriptions, DeepEquals, settled)
+}
+
+// waitForSettledSubscriptions drains ch until it delivers a Notification
+// whose Subscriptions entry for member matches want, failing the test if
+// none arrives before the deadline. It exists because a cooperative-sticky
+// rebalance that revokes and reassigns a topic may deliver an intermediate
+// revoke-phase Notification for member before the settled one.
+func waitForSettledSubscriptions(c *C, ch <-chan Notification, member string, want []string) Notification {
+	want = normalizeTopics(want)
+	deadline := time.After(2 * time.Second)
+	for {
+		select {
+		case n := <-ch:
+			if topicsEqual(normalizeTopics(n.Subscriptions[member]), want) {
+				return n
+			}
+		case <-deadline:
+			c.Fatalf("timed out waiting for %s to settle on %v", member, want)
+			return Notification{}
+		}
+	}
+}
+
+// When a member drops out of the group, planPartitionAssignment moves only
+// its partitions to the remaining members, spreading them out evenly.
+func (s *GroupRegistratorSuite) TestPlanPartitionAssignmentRemoveMember(c *C) {
+	// Given
+	partitions := []int32{0, 1, 2, 3, 4, 5}
+	prevOwners := map[int32]string{
+		0: "m1", 1: "m1",
+		2: "m2", 3: "m2",
+		4: "m3", 5: "m3",
+	}
+
+	// When: m3 leaves.
+	assignment := planPartitionAssignment(partitions, []string{"m1", "m2"}, prevOwners)
+
+	// Then: m1 and m2 keep what they had, and split m3's old partitions.
+	c.Assert(assignment[0], Equals, "m1")
+	c.Assert(assignment[1], Equals, "m1")
+	c.Assert(assignment[2], Equals, "m2")
+	c.Assert(assignment[3], Equals, "m2")
+	c.Assert(assignment[4], Not(Equals), "m3")
+	c.Assert(assignment[5], Not(Equals), "m3")
+	c.Assert(assignment[4], Not(Equals), assignment[5])
+}
+
+// When a member joins an already balanced group, planPartitionAssignment
+// moves just enough partitions off the existing members to give the newcomer
+// its fair share, leaving everyone else's remaining partitions untouched.
+func (s *GroupRegistratorSuite) TestPlanPartitionAssignmentAddMember(c *C) {
+	// Given
+	partitions := []int32{0, 1, 2, 3}
+	prevOwners := map[int32]string{0: "m1", 1: "m1", 2: "m2", 3: "m2"}
+
+	// When: m3 joins.
+	assignment := planPartitionAssignment(partitions, []string{"m1", "m2", "m3"}, prevOwners)
+
+	// Then: exactly one partition changed hands, to m3.
+	moved := 0
+	for partition, prevOwner := range prevOwners {
+		if assignment[partition] != prevOwner {
+			moved++
+			c.Assert(assignment[partition], Equals, "m3")
+		}
+	}
+	c.Assert(moved, Equals, 1)
+}
+
+// planPartitionAssignment is deterministic and covers every partition even
+// when there is no prior assignment to build on.
+func (s *GroupRegistratorSuite) TestPlanPartitionAssignmentNoPrevOwners(c *C) {
+	// Given/When
+	assignment := planPartitionAssignment([]int32{0, 1, 2}, []string{"m1", "m2"}, nil)
+
+	// Then
+	c.Assert(assignment, HasLen, 3)
+	counts := map[string]int{}
+	for _, member := range assignment {
+		counts[member]++
+	}
+	c.Assert(counts["m1"]+counts["m2"], Equals, 3)
+}
+
+// Under the sticky assignment strategy, removing one member of a 3-member
+// group only moves that member's partitions: m1 keeps every partition
+// AssignedPartitions already granted it.
+func (s *GroupRegistratorSuite) TestAssignedPartitionsStickyOnMemberLeave(c *C) {
+	// Given
+	admin, err := sarama.NewClusterAdmin(testhelpers.KafkaPeers, sarama.NewConfig())
+	c.Assert(err, IsNil)
+	defer admin.Close()
+	_ = admin.CreateTopic("gm.sticky", &sarama.TopicDetail{NumPartitions: 6, ReplicationFactor: 1}, false)
+
+	cfg := config.Default()
+	cfg.Consumer.RebalanceDelay = 100 * time.Millisecond
+	cfg.Consumer.PartitionAssignmentStrategy = config.AssignmentStrategySticky
+	cfg.ZooKeeper.SeedPeers = testhelpers.ZookeeperPeers
+	gm1 := Spawn("gm_sticky_test", "m1", cfg, s.kazooConn)
+	defer gm1.Stop()
+	gm2 := Spawn("gm_sticky_test", "m2", cfg, s.kazooConn)
+	defer gm2.Stop()
+	gm3 := Spawn("gm_sticky_test", "m3", cfg, s.kazooConn)
+
+	gm1.Topics() <- []string{"gm.sticky"}
+	gm2.Topics() <- []string{"gm.sticky"}
+	gm3.Topics() <- []string{"gm.sticky"}
+	<-gm1.Subscriptions()
+	<-gm2.Subscriptions()
+	<-gm3.Subscriptions()
+
+	before := gm1.AssignedPartitions("gm.sticky")
+	c.Assert(len(before) > 0, Equals, true)
+
+	// When: m3 leaves the group.
+	gm3.Stop()
+	<-gm1.Subscriptions()
+	<-gm2.Subscriptions()
+
+	// Then: m1 keeps every partition it had before.
+	after := gm1.AssignedPartitions("gm.sticky")
+	for _, partition := range before {
+		found := false
+		for _, p := range after {
+			found = found || p == partition
+		}
+		c.Assert(found, Equals, true)
+	}
+}
+
 // When a group registrator claims a topic partitions it becomes its owner.
 func (s *GroupRegistratorSuite) TestClaimPartition(c *C) {
 	// Given
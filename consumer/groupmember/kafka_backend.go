@@ -0,0 +1,412 @@
+package groupmember
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mailgun/kafka-pixy/actor"
+	"github.com/mailgun/kafka-pixy/config"
+	"github.com/mailgun/kafka-pixy/none"
+	"github.com/mailgun/sarama"
+	"github.com/pkg/errors"
+)
+
+// protocolType is the `ProtocolType` kafka-pixy advertises to the group
+// coordinator. It shares the `consumer` namespace with other consumer
+// implementations so that third party tools (e.g. `kafka-consumer-groups`)
+// can inspect kafka-pixy's groups.
+const protocolType = "consumer"
+
+// kafkaProtocolName is the single `GroupProtocol` kafka-pixy speaks. Brokers
+// pick a common protocol name across all joining members; since kafka-pixy
+// always proposes just this one, it always wins.
+const kafkaProtocolName = "kafka-pixy"
+
+const (
+	heartbeatInterval  = 3 * time.Second
+	sessionTimeout     = 10 * time.Second
+	rejoinRetryBackoff = 500 * time.Millisecond
+)
+
+// kafkaBackend implements Backend against a native Kafka group coordinator
+// using FindCoordinator/JoinGroup/SyncGroup/Heartbeat/LeaveGroup, bypassing
+// ZooKeeper entirely. The group leader (the member the coordinator elects
+// first) computes the assignment for the whole group and hands it out
+// through SyncGroupResponse; followers merely receive their slice of it.
+type kafkaBackend struct {
+	actorID  *actor.ID
+	cfg      *config.T
+	group    string
+	client   sarama.Client
+	memberID string
+
+	generationID int32
+	assignmentMu sync.Mutex
+	assignment   map[string][]string // last SyncGroupResponse assignment, {member -> topics}
+
+	clientMu sync.Mutex // guards client, set once run's initial connect succeeds
+
+	claimsMu sync.Mutex
+	claims   map[string]none.T
+
+	// ackCh is sent on by Ack to force the last known assignment to be
+	// redelivered, see Backend.Ack.
+	ackCh chan none.T
+
+	stopCh chan none.T
+	wg     sync.WaitGroup
+}
+
+func newKafkaBackend(actorID *actor.ID, group string, cfg *config.T) *kafkaBackend {
+	return &kafkaBackend{
+		actorID: actorID,
+		cfg:     cfg,
+		group:   group,
+		claims:  make(map[string]none.T),
+		stopCh:  make(chan none.T),
+	}
+}
+
+func (b *kafkaBackend) Join(memberID string, topicsCh <-chan []string) <-chan map[string][]string {
+	b.memberID = memberID
+	subscriptionsCh := make(chan map[string][]string)
+	b.ackCh = make(chan none.T, 1)
+	b.wg.Add(2)
+	go b.run(topicsCh, subscriptionsCh)
+	go b.watchPartitionCounts(subscriptionsCh)
+	return subscriptionsCh
+}
+
+// Ack forces the current assignment to be redelivered once, see
+// Backend.Ack.
+func (b *kafkaBackend) Ack() {
+	select {
+	case b.ackCh <- none.T{}:
+	default:
+	}
+}
+
+func (b *kafkaBackend) setClient(client sarama.Client) {
+	b.clientMu.Lock()
+	b.client = client
+	b.clientMu.Unlock()
+}
+
+func (b *kafkaBackend) getClient() sarama.Client {
+	b.clientMu.Lock()
+	defer b.clientMu.Unlock()
+	return b.client
+}
+
+// ListTopics returns every topic known to the cluster, as seen by the most
+// recent Metadata response.
+func (b *kafkaBackend) ListTopics() ([]string, error) {
+	client := b.getClient()
+	if client == nil {
+		return nil, errors.New("kafka client is not connected yet")
+	}
+	return client.Topics()
+}
+
+func (b *kafkaBackend) Stop() {
+	close(b.stopCh)
+	b.wg.Wait()
+}
+
+// run implements the JoinGroup/SyncGroup/Heartbeat cycle described in
+// KIP-62. It rejoins the group whenever the member's own topic list
+// changes or the coordinator asks it to via a REBALANCE_IN_PROGRESS error
+// on a heartbeat.
+func (b *kafkaBackend) run(topicsCh <-chan []string, subscriptionsCh chan<- map[string][]string) {
+	defer b.wg.Done()
+	defer close(subscriptionsCh)
+	defer b.leaveGroup()
+
+	client, err := sarama.NewClient(b.cfg.BrokerAddrs(), b.cfg.SaramaClientCfg())
+	if err != nil {
+		return
+	}
+	b.setClient(client)
+	defer client.Close()
+
+	var topics []string
+	var rejoinCh <-chan time.Time
+
+	// heartbeatTicker must be created once outside the loop: a fresh
+	// time.After(heartbeatInterval) in the select below would be
+	// re-evaluated on every loop iteration, so repeated rejoin retries
+	// during a coordinator outage would keep pushing the heartbeat back
+	// and risk the session timing out instead.
+	heartbeatTicker := time.NewTicker(heartbeatInterval)
+	defer heartbeatTicker.Stop()
+
+	for {
+		select {
+		case newTopics := <-topicsCh:
+			topics = normalizeTopics(newTopics)
+			if err := b.joinAndSync(topics, subscriptionsCh); err != nil {
+				rejoinCh = time.After(rejoinRetryBackoff)
+			}
+
+		case <-rejoinCh:
+			rejoinCh = nil
+			if err := b.joinAndSync(topics, subscriptionsCh); err != nil {
+				rejoinCh = time.After(rejoinRetryBackoff)
+			}
+
+		case <-heartbeatTicker.C:
+			if err := b.heartbeat(); err != nil {
+				rejoinCh = time.After(rejoinRetryBackoff)
+			}
+
+		case <-b.ackCh:
+			// See Backend.Ack: redeliver the last assignment we know
+			// about, even though it hasn't changed.
+			b.assignmentMu.Lock()
+			assignment := b.assignment
+			b.assignmentMu.Unlock()
+			if assignment != nil {
+				select {
+				case subscriptionsCh <- assignment:
+				case <-b.stopCh:
+					return
+				}
+			}
+
+		case <-b.stopCh:
+			return
+		}
+	}
+}
+
+// joinAndSync performs one JoinGroup/SyncGroup round trip, publishing the
+// resulting assignment as a group-wide subscription snapshot.
+func (b *kafkaBackend) joinAndSync(topics []string, subscriptionsCh chan<- map[string][]string) error {
+	coordinator, err := b.getClient().Coordinator(b.group)
+	if err != nil {
+		return errors.Wrap(err, "failed to find group coordinator")
+	}
+
+	joinReq := &sarama.JoinGroupRequest{
+		GroupId:        b.group,
+		MemberId:       b.memberID,
+		SessionTimeout: int32(sessionTimeout / time.Millisecond),
+		ProtocolType:   protocolType,
+	}
+	_ = joinReq.AddGroupProtocolMetadata(kafkaProtocolName, &sarama.ConsumerGroupMemberMetadata{Topics: topics})
+
+	joinResp, err := coordinator.JoinGroup(joinReq)
+	if err != nil {
+		return errors.Wrap(err, "failed to join group")
+	}
+	b.memberID = joinResp.MemberId
+	b.generationID = joinResp.GenerationId
+
+	syncReq := &sarama.SyncGroupRequest{
+		GroupId:      b.group,
+		GenerationId: joinResp.GenerationId,
+		MemberId:     joinResp.MemberId,
+	}
+	if joinResp.LeaderId == joinResp.MemberId {
+		assignment, err := assignTopics(joinResp.Members)
+		if err != nil {
+			return errors.Wrap(err, "failed to compute group assignment")
+		}
+		for memberID, memberTopics := range assignment {
+			_ = syncReq.AddGroupAssignmentMember(memberID, &sarama.ConsumerGroupMemberAssignment{Topics: memberTopics})
+		}
+	}
+
+	syncResp, err := coordinator.SyncGroup(syncReq)
+	if err != nil {
+		return errors.Wrap(err, "failed to sync group")
+	}
+	if _, err := syncResp.GetMemberAssignment(); err != nil {
+		return errors.Wrap(err, "failed to decode member assignment")
+	}
+
+	subscriptions, err := b.groupSubscriptions(coordinator)
+	if err != nil {
+		return errors.Wrap(err, "failed to describe group")
+	}
+
+	b.assignmentMu.Lock()
+	b.assignment = subscriptions
+	b.assignmentMu.Unlock()
+
+	select {
+	case subscriptionsCh <- subscriptions:
+	case <-b.stopCh:
+	}
+	return nil
+}
+
+// groupSubscriptions asks the coordinator for every member's current
+// assignment via DescribeGroups and decodes each into a `{member -> topics}`
+// snapshot. joinAndSync itself only learns its own slice of the assignment
+// from SyncGroupResponse; DescribeGroups is what lets both the leader and
+// its followers publish the same group-wide view `Backend.Join` promises.
+func (b *kafkaBackend) groupSubscriptions(coordinator *sarama.Broker) (map[string][]string, error) {
+	resp, err := coordinator.DescribeGroups(&sarama.DescribeGroupsRequest{Groups: []string{b.group}})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to send DescribeGroups")
+	}
+	if len(resp.Groups) != 1 {
+		return nil, errors.Errorf("unexpected DescribeGroups response for group %q", b.group)
+	}
+	return decodeGroupAssignments(resp.Groups[0].Members)
+}
+
+// decodeGroupAssignments decodes a DescribeGroupsResponse group's raw
+// per-member assignment bytes into a `{member -> topics}` snapshot. It is
+// split out of groupSubscriptions so the decoding can be unit tested
+// without a live coordinator.
+func decodeGroupAssignments(members map[string]*sarama.GroupMemberDescription) (map[string][]string, error) {
+	subscriptions := make(map[string][]string, len(members))
+	for memberID, member := range members {
+		// ConsumerGroupMemberAssignment.decode is only reachable through
+		// SyncGroupResponse, so reuse that rather than duplicating it here.
+		memberSyncResp := &sarama.SyncGroupResponse{MemberAssignment: member.MemberAssignment}
+		assignment, err := memberSyncResp.GetMemberAssignment()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to decode assignment for member %q", memberID)
+		}
+		if topics := normalizeTopics(assignment.Topics); len(topics) > 0 {
+			subscriptions[memberID] = topics
+		}
+	}
+	return subscriptions, nil
+}
+
+func (b *kafkaBackend) heartbeat() error {
+	coordinator, err := b.getClient().Coordinator(b.group)
+	if err != nil {
+		return err
+	}
+	req := &sarama.HeartbeatRequest{
+		GroupId:      b.group,
+		GenerationId: b.generationID,
+		MemberId:     b.memberID,
+	}
+	resp, err := coordinator.Heartbeat(req)
+	if err != nil {
+		return err
+	}
+	if resp.Err != sarama.ErrNoError {
+		return resp.Err
+	}
+	return nil
+}
+
+func (b *kafkaBackend) leaveGroup() {
+	client := b.getClient()
+	if client == nil {
+		// run's initial sarama.NewClient never succeeded, so there is no
+		// group membership to leave.
+		return
+	}
+	coordinator, err := client.Coordinator(b.group)
+	if err != nil {
+		return
+	}
+	_, _ = coordinator.LeaveGroup(&sarama.LeaveGroupRequest{GroupId: b.group, MemberId: b.memberID})
+}
+
+// assignTopics is the leader-side assignment strategy: every member that
+// subscribed to a topic gets it, with no partition-level granularity yet
+// since partition ownership among the group's own consumers is still
+// resolved by ClaimPartition.
+func assignTopics(members map[string]sarama.ConsumerGroupMemberMetadata) (map[string][]string, error) {
+	assignment := make(map[string][]string, len(members))
+	memberIDs := make([]string, 0, len(members))
+	for memberID := range members {
+		memberIDs = append(memberIDs, memberID)
+	}
+	sort.Strings(memberIDs)
+	for _, memberID := range memberIDs {
+		assignment[memberID] = normalizeTopics(members[memberID].Topics)
+	}
+	return assignment, nil
+}
+
+// watchPartitionCounts periodically issues a Metadata request for every
+// topic in the current assignment and republishes it whenever a topic's
+// partition count changed, so that partition consumers downstream learn to
+// `ClaimPartition` the new ones. This is the kafka-backend counterpart of
+// zkBackend.watchPartitionCounts, polling Metadata instead of ZooKeeper.
+func (b *kafkaBackend) watchPartitionCounts(subscriptionsCh chan<- map[string][]string) {
+	defer b.wg.Done()
+
+	interval := b.cfg.Consumer.PartitionWatchInterval
+	if interval <= 0 {
+		interval = defaultPartitionWatchInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastCount := make(map[string]int)
+	for {
+		select {
+		case <-ticker.C:
+			client := b.getClient()
+			if client == nil {
+				continue
+			}
+			b.assignmentMu.Lock()
+			assignment := b.assignment
+			b.assignmentMu.Unlock()
+
+			changed := false
+			for _, topics := range assignment {
+				for _, topic := range topics {
+					_ = client.RefreshMetadata(topic)
+					partitions, err := client.Partitions(topic)
+					if err != nil {
+						continue
+					}
+					count := len(partitions)
+					prev, seen := lastCount[topic]
+					lastCount[topic] = count
+					if seen && prev != count {
+						changed = true
+					}
+				}
+			}
+			if !changed || assignment == nil {
+				continue
+			}
+			select {
+			case subscriptionsCh <- assignment:
+			case <-b.stopCh:
+				return
+			}
+
+		case <-b.stopCh:
+			return
+		}
+	}
+}
+
+// AssignedPartitions always returns nil under the kafka backend: the group
+// coordinator protocol only assigns whole topics (see assignTopics), so
+// there is no per-partition sticky plan to consult yet.
+func (b *kafkaBackend) AssignedPartitions(topic string) []int32 {
+	return nil
+}
+
+// ClaimPartition only records the claim locally and returns at once under
+// the kafka backend. It does not check whether another member holds the
+// same partition: assignTopics gives a topic to every member subscribed to
+// it, so two members may claim the same partition at the same time.
+func (b *kafkaBackend) ClaimPartition(cid *actor.ID, topic string, partition int32, cancelCh <-chan none.T) func() {
+	key := partitionKey(topic, partition)
+	b.claimsMu.Lock()
+	b.claims[key] = none.T{}
+	b.claimsMu.Unlock()
+	return func() {
+		b.claimsMu.Lock()
+		delete(b.claims, key)
+		b.claimsMu.Unlock()
+	}
+}
@@ -0,0 +1,68 @@
+package groupmember
+
+import (
+	"github.com/mailgun/sarama"
+	. "gopkg.in/check.v1"
+)
+
+// assignTopics assigns every member's own requested topics back to it, in
+// deterministic (lexically sorted by member id) order.
+func (s *GroupRegistratorSuite) TestAssignTopics(c *C) {
+	// Given
+	members := map[string]sarama.ConsumerGroupMemberMetadata{
+		"m2": {Topics: []string{"bazz"}},
+		"m1": {Topics: []string{"foo", "bar"}},
+	}
+
+	// When
+	assignment, err := assignTopics(members)
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(assignment, DeepEquals, map[string][]string{
+		"m1": {"bar", "foo"},
+		"m2": {"bazz"},
+	})
+}
+
+// encodeAssignment round trips topics through the same
+// AddGroupAssignmentMember encoding the real JoinGroup/SyncGroup path uses,
+// to get raw wire bytes without talking to a live coordinator.
+func encodeAssignment(c *C, topics []string) []byte {
+	req := &sarama.SyncGroupRequest{}
+	err := req.AddGroupAssignmentMember("irrelevant", &sarama.ConsumerGroupMemberAssignment{Topics: topics})
+	c.Assert(err, IsNil)
+	return req.GroupAssignments["irrelevant"]
+}
+
+// decodeGroupAssignments decodes every member's raw assignment bytes, and
+// omits members whose assignment is empty.
+func (s *GroupRegistratorSuite) TestDecodeGroupAssignments(c *C) {
+	// Given
+	members := map[string]*sarama.GroupMemberDescription{
+		"m1": {MemberAssignment: encodeAssignment(c, []string{"foo", "bar"})},
+		"m2": {MemberAssignment: encodeAssignment(c, nil)},
+	}
+
+	// When
+	subscriptions, err := decodeGroupAssignments(members)
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(subscriptions, DeepEquals, map[string][]string{"m1": {"bar", "foo"}})
+}
+
+// decodeGroupAssignments propagates a decode failure for a malformed
+// member assignment instead of silently dropping it.
+func (s *GroupRegistratorSuite) TestDecodeGroupAssignmentsMalformed(c *C) {
+	// Given
+	members := map[string]*sarama.GroupMemberDescription{
+		"m1": {MemberAssignment: []byte{0xff, 0xff}},
+	}
+
+	// When
+	_, err := decodeGroupAssignments(members)
+
+	// Then
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,577 @@
+package groupmember
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mailgun/kafka-pixy/actor"
+	"github.com/mailgun/kafka-pixy/config"
+	"github.com/mailgun/kafka-pixy/none"
+	"github.com/pkg/errors"
+	"github.com/samuel/go-zookeeper/zk"
+	"github.com/wvanbergen/kazoo-go"
+)
+
+// partitionClaimRetryInterval is how often a blocked ClaimPartition call
+// checks whether the partition it wants has been released.
+const partitionClaimRetryInterval = 250 * time.Millisecond
+
+// defaultPartitionWatchInterval is used when
+// `cfg.Consumer.PartitionWatchInterval` is left unset.
+const defaultPartitionWatchInterval = 30 * time.Second
+
+// zkDialTimeout bounds how long connecting the raw ZooKeeper connection
+// refreshPartitionAssignment persists the sticky assignment plan through
+// may take.
+const zkDialTimeout = 10 * time.Second
+
+// zkBackend implements Backend on top of the legacy ZooKeeper managed
+// `/consumers` tree via kazoo-go. Group membership and topic subscriptions
+// live in per-instance znodes, and partition ownership is tracked with
+// ephemeral znodes that kazoo-go exposes through `ConsumergroupInstance`.
+type zkBackend struct {
+	actorID    *actor.ID
+	cfg        *config.T
+	group      string
+	kazooConn  *kazoo.Kazoo
+	groupZNode *kazoo.Consumergroup
+	memberID   string
+	instance   *kazoo.ConsumergroupInstance
+
+	claimsMu sync.Mutex
+	claims   map[string]int
+
+	watchedTopicsMu sync.Mutex
+	watchedTopics   []string
+
+	// assignmentMu guards assignment and generation, the group's sticky
+	// partition assignment plan. Every member reads it to learn which
+	// partitions it should try to claim; only the group leader (the
+	// lexicographically smallest member ID) writes it.
+	assignmentMu sync.Mutex
+	assignment   map[string]map[int32]string // {topic -> {partition -> member}}
+	generation   int32
+
+	// rawZKConn is a direct ZooKeeper connection dialed from
+	// `cfg.ZooKeeper.SeedPeers` (not taken from kazooConn), used only to
+	// persist the sticky assignment plan:
+	// kazoo-go has no notion of a generation-keyed assignment znode (it
+	// only ever tracks ephemeral partition-claim znodes), so
+	// refreshPartitionAssignment reads/writes it through go-zookeeper/zk,
+	// the library kazoo-go itself is built on, instead.
+	rawZKConnMu sync.Mutex
+	rawZKConn   *zk.Conn
+
+	// ackCh is sent on by Ack to force a republish that bypasses run's own
+	// `lastSubscriptions` dedup, see Backend.Ack.
+	ackCh chan none.T
+
+	stopCh chan none.T
+	wg     sync.WaitGroup
+}
+
+func newZKBackend(actorID *actor.ID, group string, cfg *config.T, kazooConn *kazoo.Kazoo) *zkBackend {
+	return &zkBackend{
+		actorID:    actorID,
+		cfg:        cfg,
+		group:      group,
+		kazooConn:  kazooConn,
+		groupZNode: kazooConn.Consumergroup(group),
+		claims:     make(map[string]int),
+		stopCh:     make(chan none.T),
+	}
+}
+
+func (b *zkBackend) Join(memberID string, topicsCh <-chan []string) <-chan map[string][]string {
+	b.memberID = memberID
+	b.instance = b.groupZNode.Instance(memberID)
+
+	subscriptionsCh := make(chan map[string][]string)
+	partitionsChangedCh := make(chan none.T, 1)
+	b.ackCh = make(chan none.T, 1)
+
+	b.wg.Add(2)
+	go b.watchPartitionCounts(partitionsChangedCh)
+	go b.run(topicsCh, partitionsChangedCh, subscriptionsCh)
+	return subscriptionsCh
+}
+
+// Ack forces run's next loop iteration to republish the group's current
+// subscriptions even if they are unchanged from what was last sent, see
+// Backend.Ack.
+func (b *zkBackend) Ack() {
+	select {
+	case b.ackCh <- none.T{}:
+	default:
+	}
+}
+
+func (b *zkBackend) Stop() {
+	close(b.stopCh)
+	b.wg.Wait()
+
+	b.rawZKConnMu.Lock()
+	if b.rawZKConn != nil {
+		b.rawZKConn.Close()
+	}
+	b.rawZKConnMu.Unlock()
+}
+
+func (b *zkBackend) run(topicsCh <-chan []string, partitionsChangedCh <-chan none.T, subscriptionsCh chan<- map[string][]string) {
+	defer b.wg.Done()
+	defer close(subscriptionsCh)
+	defer func() { _ = b.instance.Deregister() }()
+
+	watchCh, err := b.groupZNode.WatchInstances()
+	if err != nil {
+		return
+	}
+
+	var rebalanceTimerCh <-chan time.Time
+	var pendingTopics []string
+	havePending := false
+	lastSubscriptions := map[string][]string(nil)
+
+	publish := func() {
+		// A member subscribed to no topics is not notified of the group's
+		// subscriptions.
+		if len(b.getWatchedTopics()) == 0 {
+			return
+		}
+		subscriptions, err := b.readSubscriptions()
+		if err != nil {
+			return
+		}
+		if b.cfg.Consumer.PartitionAssignmentStrategy == config.AssignmentStrategySticky {
+			b.refreshPartitionAssignment(subscriptions)
+		}
+		if subscriptionsEqual(subscriptions, lastSubscriptions) {
+			return
+		}
+		lastSubscriptions = subscriptions
+		select {
+		case subscriptionsCh <- subscriptions:
+		case <-b.stopCh:
+		}
+	}
+
+	for {
+		select {
+		case topics := <-topicsCh:
+			pendingTopics = normalizeTopics(topics)
+			havePending = true
+			rebalanceTimerCh = time.After(b.cfg.Consumer.RebalanceDelay)
+
+		case <-rebalanceTimerCh:
+			rebalanceTimerCh = nil
+			if !havePending {
+				continue
+			}
+			havePending = false
+			if err := b.register(pendingTopics); err != nil {
+				continue
+			}
+			b.setWatchedTopics(pendingTopics)
+			publish()
+
+		case _, ok := <-watchCh:
+			if !ok {
+				return
+			}
+			if watchCh, err = b.groupZNode.WatchInstances(); err != nil {
+				return
+			}
+			publish()
+
+		case <-partitionsChangedCh:
+			// A subscribed topic gained (or lost) partitions. The
+			// `{member -> topics}` snapshot itself is unchanged, so force
+			// a republish past the equality check in publish: that is the only
+			// way partition consumers downstream learn they should
+			// `ClaimPartition` the new ones.
+			lastSubscriptions = nil
+			publish()
+
+		case <-b.ackCh:
+			// See Backend.Ack: force the same republish-bypassing-dedup
+			// path partitionsChangedCh uses above, so that `T.run`'s
+			// pending-assign equality gate has something to match against.
+			lastSubscriptions = nil
+			publish()
+
+		case <-b.stopCh:
+			return
+		}
+	}
+}
+
+// setWatchedTopics records the topics this member is currently subscribed
+// to, so that watchPartitionCounts knows what to poll.
+func (b *zkBackend) setWatchedTopics(topics []string) {
+	b.watchedTopicsMu.Lock()
+	b.watchedTopics = topics
+	b.watchedTopicsMu.Unlock()
+}
+
+func (b *zkBackend) getWatchedTopics() []string {
+	b.watchedTopicsMu.Lock()
+	defer b.watchedTopicsMu.Unlock()
+	return b.watchedTopics
+}
+
+// watchPartitionCounts periodically polls the partition count of every
+// currently subscribed topic and signals partitionsChangedCh whenever one
+// has grown or shrunk, e.g. because an admin ran
+// `kafka-topics --alter --partitions`. Modeled after sarama's
+// `loopCheckPartitionNumbers`.
+func (b *zkBackend) watchPartitionCounts(partitionsChangedCh chan<- none.T) {
+	defer b.wg.Done()
+
+	interval := b.cfg.Consumer.PartitionWatchInterval
+	if interval <= 0 {
+		interval = defaultPartitionWatchInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastCount := make(map[string]int)
+	for {
+		select {
+		case <-ticker.C:
+			for _, topic := range b.getWatchedTopics() {
+				partitions, err := b.groupZNode.Topic(topic).Partitions()
+				if err != nil {
+					continue
+				}
+				count := len(partitions)
+				prev, seen := lastCount[topic]
+				lastCount[topic] = count
+				if seen && prev != count {
+					select {
+					case partitionsChangedCh <- none.T{}:
+					default:
+					}
+				}
+			}
+		case <-b.stopCh:
+			return
+		}
+	}
+}
+
+// register writes the member's current topic list to its instance znode,
+// or deregisters the instance altogether when topics is empty.
+func (b *zkBackend) register(topics []string) error {
+	if len(topics) == 0 {
+		if b.instance.Registered {
+			return b.instance.Deregister()
+		}
+		return nil
+	}
+	if !b.instance.Registered {
+		return b.instance.Register(topics)
+	}
+	return b.instance.UpdateRegistration(topics)
+}
+
+// readSubscriptions builds a `{member -> topics}` snapshot of the whole
+// group from the instance znodes currently registered in ZooKeeper.
+func (b *zkBackend) readSubscriptions() (map[string][]string, error) {
+	instances, err := b.groupZNode.Instances()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list group instances")
+	}
+	subscriptions := make(map[string][]string)
+	for _, inst := range instances {
+		if !inst.Registered {
+			continue
+		}
+		topics := make([]string, 0, len(inst.Registration.Subscription))
+		for topic := range inst.Registration.Subscription {
+			topics = append(topics, topic)
+		}
+		if len(topics) == 0 {
+			continue
+		}
+		sort.Strings(topics)
+		subscriptions[inst.ID] = topics
+	}
+	return subscriptions, nil
+}
+
+// refreshPartitionAssignment keeps the group's sticky partition assignment
+// plan up to date: the leader (the lexicographically smallest member ID in
+// subscriptions) recomputes and persists it whenever the group's topics or
+// membership change; every other member just re-reads whatever the leader
+// last persisted.
+func (b *zkBackend) refreshPartitionAssignment(subscriptions map[string][]string) {
+	members := make([]string, 0, len(subscriptions))
+	membersOf := make(map[string][]string) // {topic -> members subscribed to it}
+	for member, topics := range subscriptions {
+		members = append(members, member)
+		for _, topic := range topics {
+			membersOf[topic] = append(membersOf[topic], member)
+		}
+	}
+	sort.Strings(members)
+	if len(members) == 0 || members[0] != b.memberID {
+		generation, assignment, err := b.fetchAssignment()
+		if err == nil {
+			b.assignmentMu.Lock()
+			b.generation, b.assignment = generation, assignment
+			b.assignmentMu.Unlock()
+		}
+		return
+	}
+
+	b.assignmentMu.Lock()
+	prev := b.assignment
+	b.assignmentMu.Unlock()
+
+	assignment := make(map[string]map[int32]string, len(membersOf))
+	for topic, topicMembers := range membersOf {
+		partitions, err := b.groupZNode.Topic(topic).Partitions()
+		if err != nil {
+			continue
+		}
+		partitionIDs := make([]int32, len(partitions))
+		for i, p := range partitions {
+			partitionIDs[i] = p.ID
+		}
+		assignment[topic] = planPartitionAssignment(partitionIDs, topicMembers, prev[topic])
+	}
+
+	generation := b.generation + 1
+	if err := b.saveAssignment(generation, assignment); err != nil {
+		return
+	}
+	b.assignmentMu.Lock()
+	b.generation, b.assignment = generation, assignment
+	b.assignmentMu.Unlock()
+}
+
+// zkConn lazily dials the raw ZooKeeper connection used to persist and read
+// back the sticky assignment plan, see the rawZKConn field comment.
+func (b *zkBackend) zkConn() (*zk.Conn, error) {
+	b.rawZKConnMu.Lock()
+	defer b.rawZKConnMu.Unlock()
+
+	if b.rawZKConn != nil {
+		return b.rawZKConn, nil
+	}
+	conn, _, err := zk.Connect(b.cfg.ZooKeeper.SeedPeers, zkDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	b.rawZKConn = conn
+	return conn, nil
+}
+
+// assignmentPath returns the znode a given generation's assignment is
+// persisted under, chrooted the same way kazoo-go chroots its own paths.
+func (b *zkBackend) assignmentPath(generation int32) string {
+	path := fmt.Sprintf("/consumers/%s/assignment/%d", b.group, generation)
+	return b.cfg.ZooKeeper.Chroot + path
+}
+
+// saveAssignment persists the group's assignment plan for generation under
+// its own znode, creating it if it does not exist yet and overwriting it
+// otherwise.
+func (b *zkBackend) saveAssignment(generation int32, assignment map[string]map[int32]string) error {
+	conn, err := b.zkConn()
+	if err != nil {
+		return errors.Wrap(err, "failed to connect to zookeeper")
+	}
+	data, err := json.Marshal(assignment)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode assignment")
+	}
+
+	path := b.assignmentPath(generation)
+	if err := zkMkdirRecursive(conn, path[:strings.LastIndex(path, "/")]); err != nil {
+		return errors.Wrap(err, "failed to create assignment parent path")
+	}
+	if _, err := conn.Create(path, data, 0, zk.WorldACL(zk.PermAll)); err != nil {
+		if err != zk.ErrNodeExists {
+			return errors.Wrap(err, "failed to create assignment znode")
+		}
+		if _, err := conn.Set(path, data, -1); err != nil {
+			return errors.Wrap(err, "failed to update assignment znode")
+		}
+	}
+	return nil
+}
+
+// fetchAssignment reads back the highest generation assignment persisted by
+// saveAssignment. It returns a nil assignment without error if no
+// generation has been saved yet.
+func (b *zkBackend) fetchAssignment() (int32, map[string]map[int32]string, error) {
+	conn, err := b.zkConn()
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "failed to connect to zookeeper")
+	}
+
+	base := b.cfg.ZooKeeper.Chroot + fmt.Sprintf("/consumers/%s/assignment", b.group)
+	children, _, err := conn.Children(base)
+	if err != nil {
+		if err == zk.ErrNoNode {
+			return 0, nil, nil
+		}
+		return 0, nil, errors.Wrap(err, "failed to list assignment generations")
+	}
+
+	latest := int32(-1)
+	for _, child := range children {
+		generation, err := strconv.ParseInt(child, 10, 32)
+		if err != nil {
+			continue
+		}
+		if int32(generation) > latest {
+			latest = int32(generation)
+		}
+	}
+	if latest < 0 {
+		return 0, nil, nil
+	}
+
+	data, _, err := conn.Get(fmt.Sprintf("%s/%d", base, latest))
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "failed to read assignment znode")
+	}
+	assignment := make(map[string]map[int32]string)
+	if err := json.Unmarshal(data, &assignment); err != nil {
+		return 0, nil, errors.Wrap(err, "failed to decode assignment znode")
+	}
+	return latest, assignment, nil
+}
+
+// zkMkdirRecursive creates path and any missing ancestors as persistent
+// znodes, the same way kazoo-go's own unexported mkdirRecursive does for
+// its internal paths.
+func zkMkdirRecursive(conn *zk.Conn, path string) error {
+	if path == "" || path == "/" {
+		return nil
+	}
+	if parent := path[:strings.LastIndex(path, "/")]; parent != "" {
+		if err := zkMkdirRecursive(conn, parent); err != nil {
+			return err
+		}
+	}
+	exists, _, err := conn.Exists(path)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	_, err = conn.Create(path, nil, 0, zk.WorldACL(zk.PermAll))
+	if err != nil && err != zk.ErrNodeExists {
+		return err
+	}
+	return nil
+}
+
+// AssignedPartitions returns the partitions of topic the sticky assignment
+// plan currently grants to this member.
+func (b *zkBackend) AssignedPartitions(topic string) []int32 {
+	b.assignmentMu.Lock()
+	defer b.assignmentMu.Unlock()
+
+	var partitions []int32
+	for partition, member := range b.assignment[topic] {
+		if member == b.memberID {
+			partitions = append(partitions, partition)
+		}
+	}
+	sort.Slice(partitions, func(i, j int) bool { return partitions[i] < partitions[j] })
+	return partitions
+}
+
+// isStickyOwner reports whether the sticky assignment plan grants
+// topic/partition to this member, in which case ClaimPartition should not
+// have to contend for it with anyone else.
+func (b *zkBackend) isStickyOwner(topic string, partition int32) bool {
+	if b.cfg.Consumer.PartitionAssignmentStrategy != config.AssignmentStrategySticky {
+		return false
+	}
+	b.assignmentMu.Lock()
+	defer b.assignmentMu.Unlock()
+	return b.assignment[topic][partition] == b.memberID
+}
+
+func (b *zkBackend) ClaimPartition(cid *actor.ID, topic string, partition int32, cancelCh <-chan none.T) func() {
+	key := partitionKey(topic, partition)
+
+	b.claimsMu.Lock()
+	if b.claims[key] > 0 {
+		b.claims[key]++
+		b.claimsMu.Unlock()
+		return func() { b.releasePartition(topic, partition) }
+	}
+	b.claimsMu.Unlock()
+
+	if b.isStickyOwner(topic, partition) {
+		// The sticky plan guarantees no other member is assigned this
+		// partition, so a single attempt should always succeed; fall
+		// through to the regular retry loop below on the rare chance it
+		// doesn't (e.g. a previous owner's claim znode hasn't expired yet).
+		if err := b.instance.ClaimPartition(topic, partition); err == nil {
+			b.claimsMu.Lock()
+			b.claims[key]++
+			b.claimsMu.Unlock()
+			return func() { b.releasePartition(topic, partition) }
+		}
+	}
+
+	retryTicker := time.NewTicker(partitionClaimRetryInterval)
+	defer retryTicker.Stop()
+	for {
+		if err := b.instance.ClaimPartition(topic, partition); err == nil {
+			break
+		}
+		select {
+		case <-retryTicker.C:
+		case <-cancelCh:
+			return func() {}
+		}
+	}
+
+	b.claimsMu.Lock()
+	b.claims[key]++
+	b.claimsMu.Unlock()
+	return func() { b.releasePartition(topic, partition) }
+}
+
+func (b *zkBackend) releasePartition(topic string, partition int32) {
+	key := partitionKey(topic, partition)
+
+	// The partition is released as soon as any of its claims is released,
+	// however many times it was claimed.
+	b.claimsMu.Lock()
+	defer b.claimsMu.Unlock()
+	delete(b.claims, key)
+	_ = b.instance.ReleasePartition(topic, partition)
+}
+
+func partitionKey(topic string, partition int32) string {
+	return fmt.Sprintf("%s/%d", topic, partition)
+}
+
+// ListTopics returns every topic known to the cluster, as seen by the
+// ZooKeeper `/brokers/topics` tree.
+func (b *zkBackend) ListTopics() ([]string, error) {
+	topics, err := b.kazooConn.Topics()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list cluster topics")
+	}
+	names := make([]string, len(topics))
+	for i, topic := range topics {
+		names[i] = topic.Name
+	}
+	return names, nil
+}